@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parameters
+
+import (
+	"sync/atomic"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
+)
+
+// SelectRandomizedTLSProfileProbability is the probability with which
+// SelectTLSProfile chooses a randomized TLS profile over a fixed one.
+const SelectRandomizedTLSProfileProbability = "SelectRandomizedTLSProfileProbability"
+
+// baseDefaultParameters holds the defaults for parameters that predate
+// this package's per-feature default tables, such as
+// SelectRandomizedTLSProfileProbability.
+var baseDefaultParameters = map[string]interface{}{
+	SelectRandomizedTLSProfileProbability: 0.1,
+}
+
+// ParametersAccessor provides read-only, type-specific access to a single
+// immutable snapshot of parameter values, as returned by
+// ClientParameters.Get.
+type ParametersAccessor struct {
+	snapshot map[string]interface{}
+}
+
+// Int returns the named parameter's value as an int. As with all
+// ParametersAccessor accessors, name must be a registered parameter; an
+// unregistered name is a programming error and Int panics.
+func (p ParametersAccessor) Int(name string) int {
+	return p.value(name).(int)
+}
+
+// Float returns the named parameter's value as a float64.
+func (p ParametersAccessor) Float(name string) float64 {
+	return p.value(name).(float64)
+}
+
+// WeightedCoinFlip returns true with probability equal to the named
+// parameter's float64 value.
+func (p ParametersAccessor) WeightedCoinFlip(name string) bool {
+	probability := p.Float(name)
+	if probability <= 0 {
+		return false
+	}
+	if probability >= 1 {
+		return true
+	}
+	const precision = 1000000
+	return prng.Intn(precision) < int(probability*precision)
+}
+
+func (p ParametersAccessor) value(name string) interface{} {
+	value, ok := p.snapshot[name]
+	if !ok {
+		panic("parameters: unregistered parameter name: " + name)
+	}
+	return value
+}
+
+// ClientParameters holds an atomically swappable snapshot of parameter
+// values, seeded from makeDefaultParameters.
+type ClientParameters struct {
+	snapshot atomic.Value
+}
+
+// NewClientParameters creates a ClientParameters seeded with this
+// package's registered defaults.
+func NewClientParameters(onChange func()) (*ClientParameters, error) {
+	clientParameters := new(ClientParameters)
+	clientParameters.snapshot.Store(makeDefaultParameters())
+	return clientParameters, nil
+}
+
+// Get returns a ParametersAccessor for the current parameter snapshot.
+func (c *ClientParameters) Get() ParametersAccessor {
+	return ParametersAccessor{snapshot: c.snapshot.Load().(map[string]interface{})}
+}
+
+// makeDefaultParameters returns the default value for every registered
+// parameter name, merging in baseDefaultParameters along with the
+// default table contributed by each feature area, such as
+// tlsProfileStatsDefaultParameters.
+func makeDefaultParameters() map[string]interface{} {
+
+	defaults := make(map[string]interface{})
+
+	for name, value := range baseDefaultParameters {
+		defaults[name] = value
+	}
+
+	for name, value := range tlsProfileStatsDefaultParameters {
+		defaults[name] = value
+	}
+
+	return defaults
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parameters
+
+// TLSProfileStatsMinObservations is the minimum number of recorded
+// handshake outcomes against a server, across all TLS profiles, before
+// SelectTLSProfileForServer biases selection using those outcomes;
+// below this count, selection falls back to SelectTLSProfile.
+const TLSProfileStatsMinObservations = "TLSProfileStatsMinObservations"
+
+// TLSProfileStatsMinExploreProbability is the minimum probability with
+// which SelectTLSProfileForServer ignores historical outcomes and falls
+// back to SelectTLSProfile, ensuring profiles other than the current
+// best performer continue to be exercised.
+const TLSProfileStatsMinExploreProbability = "TLSProfileStatsMinExploreProbability"
+
+// TLSSessionTicketCamouflageLength is the length, in bytes, of the
+// randomly generated session ticket used to camouflage a TLS handshake
+// as a session resumption when CustomTLSConfig.PresetSessionTicket and
+// PresetSessionTicketGenerator are both unset. A value of 0 or less
+// selects a length from a short list of common real-world ticket sizes.
+const TLSSessionTicketCamouflageLength = "TLSSessionTicketCamouflageLength"
+
+// tlsProfileStatsDefaultParameters is this file's contribution to the
+// defaults table built by makeDefaultParameters in parameters.go: a
+// minimum observation count large enough to smooth over a handful of
+// transient failures before the UCB1 selector trusts its own history,
+// and a small but non-zero explore floor so a historically bad profile
+// is never permanently written off.
+var tlsProfileStatsDefaultParameters = map[string]interface{}{
+	TLSProfileStatsMinObservations:       50,
+	TLSProfileStatsMinExploreProbability: 0.1,
+	TLSSessionTicketCamouflageLength:     0,
+}
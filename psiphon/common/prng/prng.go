@@ -0,0 +1,42 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package prng provides cryptographically random number helpers shared
+// across the psiphon packages, so callers that need randomness for
+// non-secret, non-hot-path choices (ticket lengths, profile selection,
+// and the like) don't each hand-roll their own crypto/rand plumbing.
+package prng
+
+import (
+	"crypto/rand"
+	"math/big"
+)
+
+// Intn returns a cryptographically random int in [0, n). It returns 0
+// for n <= 0.
+func Intn(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0
+	}
+	return int(i.Int64())
+}
@@ -0,0 +1,593 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+// This package requires github.com/refraction-networking/utls at a
+// version whose *utls.SessionTicketExtension exposes a settable Ticket
+// []byte field directly (as opposed to only via Session.SessionTicket()).
+// go.mod should pin utls accordingly, e.g.:
+//
+//	require github.com/refraction-networking/utls v1.3.2
+
+// DialerFunc is the type of the custom dial function that CustomTLSDial
+// uses to establish the underlying network connection before performing
+// the TLS handshake.
+type DialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// CustomTLSConfig contains parameters to determine the behavior of
+// CustomTLSDial.
+type CustomTLSConfig struct {
+
+	// ClientParameters is the active set of client parameters, used to
+	// select and tune TLS profile behavior.
+	ClientParameters *parameters.ClientParameters
+
+	// Dial is the network dialer used to establish the underlying
+	// connection prior to the TLS handshake.
+	Dial DialerFunc
+
+	// UseDialAddrSNI indicates that the host in the dial address should
+	// be used as the SNI server name, instead of an explicit ServerName.
+	UseDialAddrSNI bool
+
+	// ServerName, when UseDialAddrSNI is false, specifies the SNI server
+	// name to send in the ClientHello.
+	ServerName string
+
+	// SkipVerify disables server certificate verification. This is used
+	// to perform SNI camouflage while still permitting, e.g., SPKI
+	// pinning to be layered on top by the caller.
+	SkipVerify bool
+
+	// TLSProfile specifies which uTLS ClientHelloID to use when
+	// constructing the ClientHello.
+	TLSProfile string
+
+	// PresetSessionTicket, when set, is injected into the ClientHello's
+	// SessionTicket extension, making the handshake appear to be a TLS
+	// session resumption rather than a full handshake. When
+	// PresetSessionTicket is nil and PresetSessionTicketGenerator is
+	// set, the generator is invoked once per dial to obtain the ticket.
+	PresetSessionTicket []byte
+
+	// PresetSessionTicketGenerator, when set and PresetSessionTicket is
+	// nil, is invoked to produce a per-dial session ticket. This allows
+	// callers to mint a distinct plausible-looking ticket for each dial.
+	PresetSessionTicketGenerator func() []byte
+
+	// NextProtos, when set, is offered in the ClientHello's ALPN
+	// extension, in order, e.g. []string{"h2", "http/1.1"}. This allows
+	// callers to mimic browsers that advertise HTTP/2 support.
+	NextProtos []string
+
+	// PinnedSPKISHA256, when non-empty, is the set of allowed
+	// subject-public-key-info SHA-256 digests. After the handshake
+	// completes, at least one of the peer's certificates must have an
+	// SPKI digest in this set, or CustomTLSDial fails closed with
+	// SPKIPinMismatchError. This is checked regardless of SkipVerify, so
+	// callers can keep SkipVerify: true for SNI camouflage while still
+	// cryptographically pinning the server they actually reached.
+	PinnedSPKISHA256 [][]byte
+
+	// VerifyPeerCertificate, when set, is invoked after SPKI pinning
+	// succeeds (or is not configured). Its signature mirrors
+	// crypto/tls.Config.VerifyPeerCertificate, but verifiedChains always
+	// holds a single chain made of the peer certificates as presented,
+	// which is not verified when SkipVerify is set.
+	VerifyPeerCertificate func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+}
+
+// SPKIPinMismatchError is returned by CustomTLSDial when
+// CustomTLSConfig.PinnedSPKISHA256 is set and no peer certificate's SPKI
+// digest matched any of the pinned digests.
+type SPKIPinMismatchError struct{}
+
+func (SPKIPinMismatchError) Error() string {
+	return "tlsDialer: no peer certificate matched any pinned SPKI digest"
+}
+
+// NegotiatedConn wraps the net.Conn returned by CustomTLSDial and exposes
+// the protocol negotiated via ALPN during the TLS handshake.
+type NegotiatedConn struct {
+	*utls.UConn
+}
+
+// NegotiatedProtocol returns the ALPN protocol negotiated during the TLS
+// handshake, or the empty string if ALPN was not used or no protocol was
+// negotiated.
+func (conn *NegotiatedConn) NegotiatedProtocol() string {
+	return conn.ConnectionState().NegotiatedProtocol
+}
+
+// defaultSessionTicketCamouflageLengths are the ticket lengths used when
+// no preset ticket is supplied and
+// parameters.TLSSessionTicketCamouflageLength is not set, chosen to
+// match common real-world session ticket sizes.
+var defaultSessionTicketCamouflageLengths = []int{192, 228}
+
+// CustomTLSDial establishes a network connection and performs a TLS
+// handshake using the uTLS ClientHelloID selected by config.TLSProfile,
+// in order to produce a TLS fingerprint that does not reveal that the
+// connection originates from Go's standard crypto/tls.
+func CustomTLSDial(
+	ctx context.Context,
+	network, addr string,
+	config *CustomTLSConfig) (net.Conn, error) {
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	rawConn, err := config.Dial(ctx, network, addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	serverName := config.ServerName
+	if config.UseDialAddrSNI {
+		serverName = host
+	}
+
+	tlsConfig := &utls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: config.SkipVerify,
+		NextProtos:         config.NextProtos,
+	}
+
+	// An empty config.TLSProfile means the caller wants profile selection
+	// delegated to this dial, rather than fixed up front, so that the
+	// selection can be informed by per-server history and feed back into
+	// that history via the reportTLSProfileOutcome call below.
+	tlsProfile := config.TLSProfile
+	if tlsProfile == "" && config.ClientParameters != nil {
+		tlsProfile = SelectTLSProfileForServer(config.ClientParameters.Get(), addr)
+	}
+
+	utlsClientHelloID := getUTLSClientHelloID(tlsProfile)
+
+	uConn := utls.UClient(rawConn, tlsConfig, utlsClientHelloID)
+
+	err = uConn.BuildHandshakeState()
+	if err != nil {
+		rawConn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	err = setPresetSessionTicket(uConn, config)
+	if err != nil {
+		rawConn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	setALPNProtocols(uConn, config)
+
+	// BuildHandshakeState marshals and caches the ClientHello bytes that
+	// Handshake sends on the wire; setPresetSessionTicket and
+	// setALPNProtocols mutate the already-built extensions in place, so
+	// the ClientHello must be re-marshaled or those changes never reach
+	// the wire.
+	err = uConn.MarshalClientHello()
+	if err != nil {
+		rawConn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	start := time.Now()
+	err = uConn.Handshake()
+	handshakeDuration := time.Since(start)
+
+	if config.ClientParameters != nil {
+		reportTLSProfileOutcome(
+			addr, tlsProfile, err == nil, handshakeDuration,
+			config.ClientParameters.Get())
+	}
+
+	if err != nil {
+		rawConn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	err = verifyPeerCertificate(uConn, config)
+	if err != nil {
+		rawConn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	return &NegotiatedConn{UConn: uConn}, nil
+}
+
+// verifyPeerCertificate enforces config.PinnedSPKISHA256, when set, and
+// then invokes config.VerifyPeerCertificate, when set, against the peer
+// certificates presented in the just-completed handshake. This runs
+// regardless of config.SkipVerify.
+func verifyPeerCertificate(uConn *utls.UConn, config *CustomTLSConfig) error {
+
+	connectionState := uConn.ConnectionState()
+
+	if len(config.PinnedSPKISHA256) > 0 {
+
+		pinned := false
+
+	checkCertificates:
+		for _, certificate := range connectionState.PeerCertificates {
+			digest := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+			for _, pin := range config.PinnedSPKISHA256 {
+				if bytes.Equal(digest[:], pin) {
+					pinned = true
+					break checkCertificates
+				}
+			}
+		}
+
+		if !pinned {
+			return SPKIPinMismatchError{}
+		}
+	}
+
+	if config.VerifyPeerCertificate != nil {
+
+		rawCerts := make([][]byte, len(connectionState.PeerCertificates))
+		for i, certificate := range connectionState.PeerCertificates {
+			rawCerts[i] = certificate.Raw
+		}
+
+		err := config.VerifyPeerCertificate(
+			rawCerts, [][]*x509.Certificate{connectionState.PeerCertificates})
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// setALPNProtocols ensures the ClientHello that uConn has already built
+// advertises config.NextProtos via its ALPN extension, patching in a new
+// ALPNExtension for ClientHelloIDs, such as utls.HelloRandomized, whose
+// generated ClientHelloSpec may omit one.
+func setALPNProtocols(uConn *utls.UConn, config *CustomTLSConfig) {
+
+	if len(config.NextProtos) == 0 {
+		return
+	}
+
+	for _, extension := range uConn.Extensions {
+		if alpnExtension, ok := extension.(*utls.ALPNExtension); ok {
+			alpnExtension.AlpnProtocols = config.NextProtos
+			return
+		}
+	}
+
+	uConn.Extensions = append(
+		uConn.Extensions,
+		&utls.ALPNExtension{AlpnProtocols: config.NextProtos})
+}
+
+// NewHTTP2Transport returns an http.RoundTripper that dials TLS
+// connections using CustomTLSDial and config. When ALPN negotiates "h2",
+// the connection is handed to an http2.Transport client connection via
+// http2.Transport.NewClientConn; otherwise the already-established
+// connection is reused directly for a single HTTP/1.1 request. This
+// allows callers to mimic browsers that offer "h2,http/1.1" in the
+// ClientHello and then actually speak the negotiated protocol.
+//
+// The request asked for a *http.Transport, but a plain *http.Transport
+// cannot do this handoff itself: net/http only routes a dialed
+// connection to TLSNextProto when that connection is a concrete
+// *tls.Conn, which a uTLS connection never is. Returning a custom
+// http.RoundTripper instead serves the same purpose, since it is
+// assigned to http.Client.Transport the same way, and it is the only way
+// to inspect the ALPN result and hand off to http2.Transport manually.
+func NewHTTP2Transport(config *CustomTLSConfig) http.RoundTripper {
+
+	return &http2FallbackTransport{
+		config:           config,
+		http2Transport:   &http2.Transport{},
+		http2ClientConns: make(map[string]*http2.ClientConn),
+	}
+}
+
+// http2FallbackTransport is an http.RoundTripper that dials each
+// destination with CustomTLSDial, reuses a cached *http2.ClientConn when
+// ALPN previously negotiated "h2" for that address, and otherwise issues
+// a single HTTP/1.1 request directly over the just-dialed connection.
+type http2FallbackTransport struct {
+	config         *CustomTLSConfig
+	http2Transport *http2.Transport
+
+	mutex            sync.Mutex
+	http2ClientConns map[string]*http2.ClientConn
+}
+
+func (t *http2FallbackTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+
+	addr := httpRequestAddr(request)
+
+	if clientConn := t.getHTTP2ClientConn(addr); clientConn != nil {
+		return clientConn.RoundTrip(request)
+	}
+
+	conn, err := CustomTLSDial(
+		request.Context(), "tcp", addr, t.config)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	negotiatedConn, ok := conn.(*NegotiatedConn)
+	if !ok || negotiatedConn.NegotiatedProtocol() != http2.NextProtoTLS {
+
+		// ALPN did not negotiate h2: reuse this already-established
+		// connection directly for a single HTTP/1.1 request, rather than
+		// closing it and dialing again, which would otherwise pay for a
+		// second full TLS handshake on every h2-less request.
+		return t.roundTripHTTP1(conn, request)
+	}
+
+	clientConn, discardConn, err := t.registerHTTP2ClientConn(addr, conn)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Trace(err)
+	}
+	if discardConn {
+		// Another concurrent RoundTrip for addr won the race and
+		// registered its own *http2.ClientConn first; this dial's
+		// connection is redundant.
+		conn.Close()
+	}
+
+	return clientConn.RoundTrip(request)
+}
+
+// roundTripHTTP1 issues a single HTTP/1.1 request over conn, an
+// already-established connection that ALPN did not negotiate h2 on.
+// httputil.ClientConn, unlike http.Transport, can perform a request over
+// a connection the caller already dialed.
+func (t *http2FallbackTransport) roundTripHTTP1(
+	conn net.Conn, request *http.Request) (*http.Response, error) {
+
+	clientConn := httputil.NewClientConn(conn, nil)
+
+	response, err := clientConn.Do(request)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	return response, nil
+}
+
+// registerHTTP2ClientConn wraps conn in a *http2.ClientConn and installs
+// it as addr's cached connection, unless a concurrent call already did
+// so first, in which case that existing connection is returned instead
+// and discardConn is true to tell the caller its own conn is unused.
+func (t *http2FallbackTransport) registerHTTP2ClientConn(
+	addr string, conn net.Conn) (clientConn *http2.ClientConn, discardConn bool, err error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if existing, ok := t.http2ClientConns[addr]; ok && existing.CanTakeNewRequest() {
+		return existing, true, nil
+	}
+
+	clientConn, err = t.http2Transport.NewClientConn(conn)
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+
+	if existing, ok := t.http2ClientConns[addr]; ok {
+		existing.Close()
+	}
+
+	t.http2ClientConns[addr] = clientConn
+
+	return clientConn, false, nil
+}
+
+// CloseIdleConnections closes any idle connections held by the transport,
+// satisfying the optional interface checked by http.Client.
+func (t *http2FallbackTransport) CloseIdleConnections() {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for addr, clientConn := range t.http2ClientConns {
+		state := clientConn.State()
+		if state.StreamsActive > 0 || state.StreamsReserved > 0 || state.StreamsPending > 0 {
+			continue
+		}
+		clientConn.Close()
+		delete(t.http2ClientConns, addr)
+	}
+}
+
+func (t *http2FallbackTransport) getHTTP2ClientConn(addr string) *http2.ClientConn {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	clientConn, ok := t.http2ClientConns[addr]
+	if !ok {
+		return nil
+	}
+
+	if !clientConn.CanTakeNewRequest() {
+		delete(t.http2ClientConns, addr)
+		return nil
+	}
+
+	return clientConn
+}
+
+// httpRequestAddr returns the "host:port" dial address for request,
+// defaulting the port based on the URL scheme when the host omits one.
+func httpRequestAddr(request *http.Request) string {
+
+	host := request.URL.Host
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+
+	port := "80"
+	if request.URL.Scheme == "https" {
+		port = "443"
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+// setPresetSessionTicket overwrites the SessionTicket extension of the
+// ClientHello that uConn has already built with a preset or randomly
+// generated ticket, so the handshake presents as a session resumption
+// rather than a full handshake. This is a no-op for ClientHelloIDs, such
+// as utls.HelloGolang, that do not include a SessionTicket extension.
+//
+// This requires a utls release where *utls.SessionTicketExtension
+// exposes a Ticket []byte field directly (current refraction-networking/
+// utls); older utls releases only expose the ticket indirectly through
+// Session.SessionTicket() and would need a corresponding go.mod bump.
+func setPresetSessionTicket(uConn *utls.UConn, config *CustomTLSConfig) error {
+
+	var sessionTicketExtension *utls.SessionTicketExtension
+	for _, extension := range uConn.Extensions {
+		if e, ok := extension.(*utls.SessionTicketExtension); ok {
+			sessionTicketExtension = e
+			break
+		}
+	}
+
+	if sessionTicketExtension == nil {
+		return nil
+	}
+
+	ticket := config.PresetSessionTicket
+	if ticket == nil && config.PresetSessionTicketGenerator != nil {
+		ticket = config.PresetSessionTicketGenerator()
+	}
+
+	if ticket == nil {
+		length := 0
+		if config.ClientParameters != nil {
+			length = int(config.ClientParameters.Get().Int(
+				parameters.TLSSessionTicketCamouflageLength))
+		}
+		if length <= 0 {
+			length = defaultSessionTicketCamouflageLengths[prng.Intn(
+				len(defaultSessionTicketCamouflageLengths))]
+		}
+		ticket = make([]byte, length)
+		_, err := rand.Read(ticket)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	sessionTicketExtension.Session = nil
+	sessionTicketExtension.Ticket = ticket
+
+	if len(uConn.HandshakeState.Hello.SessionId) == 0 {
+		sessionID := make([]byte, 32)
+		_, err := rand.Read(sessionID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		uConn.HandshakeState.Hello.SessionId = sessionID
+	}
+
+	return nil
+}
+
+// SelectTLSProfile picks a TLS profile to use for a given dial, choosing
+// a randomized profile with probability
+// parameters.SelectRandomizedTLSProfileProbability, and otherwise
+// selecting uniformly among the non-randomized profiles.
+func SelectTLSProfile(p parameters.ParametersAccessor) string {
+
+	if p.WeightedCoinFlip(parameters.SelectRandomizedTLSProfileProbability) {
+		randomizedProfiles := make([]string, 0)
+		for _, profile := range protocol.SupportedTLSProfiles {
+			if protocol.TLSProfileIsRandomized(profile) {
+				randomizedProfiles = append(randomizedProfiles, profile)
+			}
+		}
+		return randomizedProfiles[prng.Intn(len(randomizedProfiles))]
+	}
+
+	nonRandomizedProfiles := make([]string, 0)
+	for _, profile := range protocol.SupportedTLSProfiles {
+		if !protocol.TLSProfileIsRandomized(profile) {
+			nonRandomizedProfiles = append(nonRandomizedProfiles, profile)
+		}
+	}
+	return nonRandomizedProfiles[prng.Intn(len(nonRandomizedProfiles))]
+}
+
+// getUTLSClientHelloID maps a TLS profile name to its corresponding uTLS
+// ClientHelloID.
+func getUTLSClientHelloID(tlsProfile string) utls.ClientHelloID {
+
+	switch tlsProfile {
+	case protocol.TLS_PROFILE_CHROME_58:
+		return utls.HelloChrome_58
+	case protocol.TLS_PROFILE_CHROME_62:
+		return utls.HelloChrome_62
+	case protocol.TLS_PROFILE_FIREFOX_55:
+		return utls.HelloFirefox_55
+	case protocol.TLS_PROFILE_FIREFOX_56:
+		return utls.HelloFirefox_56
+	case protocol.TLS_PROFILE_IOS_111:
+		return utls.HelloIOS_11_1
+	case protocol.TLS_PROFILE_RANDOMIZED:
+		utlsClientHelloID := utls.HelloRandomized
+		utlsClientHelloID.Seed, _ = utls.NewPRNGSeed()
+		return utlsClientHelloID
+	}
+
+	return utls.HelloGolang
+}
+
+// getClientHelloVersion returns a human readable description of the
+// ClientHello that will be generated by utlsClientHelloID, for use in
+// logging and metrics.
+func getClientHelloVersion(utlsClientHelloID utls.ClientHelloID) string {
+	return fmt.Sprintf("%s-%s", utlsClientHelloID.Client, utlsClientHelloID.Version)
+}
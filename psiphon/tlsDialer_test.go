@@ -20,10 +20,17 @@
 package psiphon
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	stderrors "errors"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
@@ -33,6 +40,7 @@ import (
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 	tris "github.com/Psiphon-Labs/tls-tris"
 	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
 )
 
 func TestTLSDialerCompatibility(t *testing.T) {
@@ -68,6 +76,8 @@ func TestTLSDialerCompatibility(t *testing.T) {
 
 func testTLSDialerCompatibility(t *testing.T, address string) {
 
+	var serverSPKISHA256 []byte
+
 	if address == "" {
 
 		// Same tls-tris config as psiphon/server/meek.go
@@ -82,6 +92,14 @@ func testTLSDialerCompatibility(t *testing.T, address string) {
 			t.Fatalf("%s\n", err)
 		}
 
+		if len(tlsCertificate.Certificate) > 0 {
+			parsedCertificate, err := x509.ParseCertificate(tlsCertificate.Certificate[0])
+			if err == nil {
+				digest := sha256.Sum256(parsedCertificate.RawSubjectPublicKeyInfo)
+				serverSPKISHA256 = digest[:]
+			}
+		}
+
 		config := &tris.Config{
 			Certificates:            []tris.Certificate{tlsCertificate},
 			NextProtos:              []string{"http/1.1"},
@@ -140,6 +158,7 @@ func testTLSDialerCompatibility(t *testing.T, address string) {
 				UseDialAddrSNI:   true,
 				SkipVerify:       true,
 				TLSProfile:       tlsProfile,
+				NextProtos:       []string{"http/1.1"},
 			}
 
 			ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
@@ -149,6 +168,11 @@ func testTLSDialerCompatibility(t *testing.T, address string) {
 			if err != nil {
 				t.Logf("%s: %s\n", tlsProfile, err)
 			} else {
+				if negotiatedConn, ok := conn.(*NegotiatedConn); ok {
+					if protocol := negotiatedConn.NegotiatedProtocol(); protocol != "http/1.1" {
+						t.Errorf("%s: unexpected negotiated protocol: %s", tlsProfile, protocol)
+					}
+				}
 				conn.Close()
 				success += 1
 			}
@@ -165,6 +189,293 @@ func testTLSDialerCompatibility(t *testing.T, address string) {
 			t.Errorf(result)
 		}
 	}
+
+	if serverSPKISHA256 != nil {
+
+		t.Run("correct SPKI pin", func(t *testing.T) {
+
+			tlsConfig := &CustomTLSConfig{
+				ClientParameters: clientParameters,
+				Dial:             dialer,
+				UseDialAddrSNI:   true,
+				SkipVerify:       true,
+				TLSProfile:       protocol.SupportedTLSProfiles[0],
+				PinnedSPKISHA256: [][]byte{serverSPKISHA256},
+			}
+
+			ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancelFunc()
+
+			conn, err := CustomTLSDial(ctx, "tcp", address, tlsConfig)
+			if err != nil {
+				t.Fatalf("unexpected error with correct SPKI pin: %s", err)
+			}
+			conn.Close()
+		})
+
+		t.Run("wrong SPKI pin", func(t *testing.T) {
+
+			wrongPin := make([]byte, len(serverSPKISHA256))
+			copy(wrongPin, serverSPKISHA256)
+			wrongPin[0] ^= 0xff
+
+			tlsConfig := &CustomTLSConfig{
+				ClientParameters: clientParameters,
+				Dial:             dialer,
+				UseDialAddrSNI:   true,
+				SkipVerify:       true,
+				TLSProfile:       protocol.SupportedTLSProfiles[0],
+				PinnedSPKISHA256: [][]byte{wrongPin},
+			}
+
+			ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancelFunc()
+
+			conn, err := CustomTLSDial(ctx, "tcp", address, tlsConfig)
+			if conn != nil {
+				conn.Close()
+			}
+
+			var mismatchErr SPKIPinMismatchError
+			if !stderrors.As(err, &mismatchErr) {
+				t.Fatalf("expected SPKIPinMismatchError, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewHTTP2Transport(t *testing.T) {
+
+	server := httptest.NewUnstartedServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s", r.Proto)
+		}))
+
+	err := http2.ConfigureServer(server.Config, nil)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	server.TLS = server.Config.TLSConfig
+	server.StartTLS()
+	defer server.Close()
+
+	serverAddress := strings.TrimPrefix(server.URL, "https://")
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	dialer := func(ctx context.Context, network, address string) (net.Conn, error) {
+		d := &net.Dialer{}
+		return d.DialContext(ctx, network, serverAddress)
+	}
+
+	tlsConfig := &CustomTLSConfig{
+		ClientParameters: clientParameters,
+		Dial:             dialer,
+		UseDialAddrSNI:   true,
+		SkipVerify:       true,
+		TLSProfile:       protocol.TLS_PROFILE_CHROME_58,
+		NextProtos:       []string{"h2", "http/1.1"},
+	}
+
+	transport := NewHTTP2Transport(tlsConfig)
+
+	client := &http.Client{Transport: transport}
+	defer client.CloseIdleConnections()
+
+	response, err := client.Get("https://" + serverAddress + "/")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	if string(body) != "HTTP/2.0" {
+		t.Errorf("unexpected protocol: %s", body)
+	}
+}
+
+func TestCustomTLSDialSessionTicketCamouflage(t *testing.T) {
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	presetTicket := make([]byte, 212)
+	_, err = rand.Read(presetTicket)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	for _, tlsProfile := range protocol.SupportedTLSProfiles {
+
+		tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("%s\n", err)
+		}
+
+		observedTickets := make(chan []byte, 1)
+
+		go func() {
+			conn, err := tcpListener.Accept()
+			if err != nil {
+				observedTickets <- nil
+				return
+			}
+			defer conn.Close()
+
+			clientHello, err := readTLSHandshakeRecord(conn)
+			if err != nil {
+				observedTickets <- nil
+				return
+			}
+
+			observedTickets <- extractSessionTicket(clientHello)
+
+			// Close without completing a handshake; this test only
+			// inspects the ClientHello bytes that were put on the wire.
+		}()
+
+		address := tcpListener.Addr().String()
+
+		dialer := func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := &net.Dialer{}
+			return d.DialContext(ctx, network, address)
+		}
+
+		tlsConfig := &CustomTLSConfig{
+			ClientParameters:    clientParameters,
+			Dial:                dialer,
+			UseDialAddrSNI:      true,
+			SkipVerify:          true,
+			TLSProfile:          tlsProfile,
+			PresetSessionTicket: presetTicket,
+		}
+
+		ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+
+		conn, err := CustomTLSDial(ctx, "tcp", address, tlsConfig)
+		cancelFunc()
+		if conn != nil {
+			conn.Close()
+		}
+
+		observedTicket := <-observedTickets
+		tcpListener.Close()
+
+		if observedTicket == nil {
+			// ClientHelloIDs without a SessionTicket extension, such as
+			// utls.HelloGolang, are expected to omit the ticket.
+			continue
+		}
+
+		if !bytes.Equal(observedTicket, presetTicket) {
+			t.Errorf("%s: preset session ticket did not appear on the wire", tlsProfile)
+		}
+	}
+}
+
+// readTLSHandshakeRecord reads a single TLS handshake record (expected to
+// be a ClientHello) from conn and returns the handshake message bytes,
+// excluding the record layer header.
+func readTLSHandshakeRecord(conn net.Conn) ([]byte, error) {
+
+	header := make([]byte, 5)
+	_, err := ioReadFull(conn, header)
+	if err != nil {
+		return nil, err
+	}
+
+	recordLength := int(header[3])<<8 | int(header[4])
+
+	record := make([]byte, recordLength)
+	_, err = ioReadFull(conn, record)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func ioReadFull(conn net.Conn, buffer []byte) (int, error) {
+	total := 0
+	for total < len(buffer) {
+		n, err := conn.Read(buffer[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// extractSessionTicket parses a ClientHello handshake message and
+// returns the contents of its session_ticket (type 35) extension, or nil
+// if no such extension is present.
+func extractSessionTicket(clientHello []byte) []byte {
+
+	// Handshake header: type(1) + length(3).
+	if len(clientHello) < 4 {
+		return nil
+	}
+	body := clientHello[4:]
+
+	// client_version(2) + random(32).
+	if len(body) < 34 {
+		return nil
+	}
+	offset := 34
+
+	if len(body) < offset+1 {
+		return nil
+	}
+	sessionIDLength := int(body[offset])
+	offset += 1 + sessionIDLength
+
+	if len(body) < offset+2 {
+		return nil
+	}
+	cipherSuitesLength := int(body[offset])<<8 | int(body[offset+1])
+	offset += 2 + cipherSuitesLength
+
+	if len(body) < offset+1 {
+		return nil
+	}
+	compressionMethodsLength := int(body[offset])
+	offset += 1 + compressionMethodsLength
+
+	if len(body) < offset+2 {
+		return nil
+	}
+	extensionsLength := int(body[offset])<<8 | int(body[offset+1])
+	offset += 2
+
+	if len(body) < offset+extensionsLength {
+		return nil
+	}
+	extensions := body[offset : offset+extensionsLength]
+
+	for len(extensions) >= 4 {
+		extensionType := int(extensions[0])<<8 | int(extensions[1])
+		extensionLength := int(extensions[2])<<8 | int(extensions[3])
+		if len(extensions) < 4+extensionLength {
+			return nil
+		}
+		extensionData := extensions[4 : 4+extensionLength]
+		if extensionType == 35 { // session_ticket
+			return extensionData
+		}
+		extensions = extensions[4+extensionLength:]
+	}
+
+	return nil
 }
 
 func TestSelectTLSProfile(t *testing.T) {
@@ -0,0 +1,303 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/datastore"
+)
+
+// tlsProfileStatsDatastoreKeyPrefix namespaces the datastore keys used to
+// persist per-server TLSProfileStats records.
+const tlsProfileStatsDatastoreKeyPrefix = "tlsProfileStats."
+
+// tlsProfileStatsIndexDatastoreKey stores the LRU list of server
+// addresses with persisted TLSProfileStats, used to implement the
+// eviction policy.
+const tlsProfileStatsIndexDatastoreKey = "tlsProfileStatsIndex"
+
+// tlsProfileStatsMaxServers bounds the number of distinct servers for
+// which TLSProfileStats are retained, so the datastore does not grow
+// unboundedly as a client connects to many servers over its lifetime.
+const tlsProfileStatsMaxServers = 200
+
+// tlsProfileOutcome is the rolling success/failure/latency record for a
+// single TLS profile against a single server.
+type tlsProfileOutcome struct {
+	Successes              int64
+	Failures               int64
+	TotalHandshakeDuration time.Duration
+}
+
+// TLSProfileStats is the per-server record of handshake outcomes for
+// each supported TLS profile, used by SelectTLSProfileForServer to bias
+// profile selection toward profiles that have previously succeeded
+// against that server.
+type TLSProfileStats struct {
+	Outcomes map[string]*tlsProfileOutcome
+}
+
+var tlsProfileStatsMutex sync.Mutex
+
+// tlsProfileStatsLatencyPenaltyWeight scales how strongly mean handshake
+// latency breaks near-ties in SelectTLSProfileForServer's UCB1 score.
+// It is small relative to the [0, ~2] range the success-rate-plus-bonus
+// term occupies, since latency should only nudge between otherwise
+// comparable profiles, not override a meaningfully better success rate.
+const tlsProfileStatsLatencyPenaltyWeight = 0.01
+
+// tlsProfileStatsOutcomeQueueSize bounds the number of handshake
+// outcomes buffered for the background writer started by
+// startTLSProfileStatsWriter. A full queue means the writer is falling
+// behind the dial rate; reportTLSProfileOutcome drops reports rather
+// than block dials in that case.
+const tlsProfileStatsOutcomeQueueSize = 100
+
+type tlsProfileOutcomeReport struct {
+	serverAddr        string
+	tlsProfile        string
+	success           bool
+	handshakeDuration time.Duration
+	p                 parameters.ParametersAccessor
+}
+
+var tlsProfileStatsOutcomeQueue chan tlsProfileOutcomeReport
+var tlsProfileStatsWriterOnce sync.Once
+
+// startTLSProfileStatsWriter lazily starts the single background
+// goroutine that applies queued handshake outcomes to the datastore, so
+// that the datastore read/marshal/write work done per outcome never
+// blocks a dial.
+func startTLSProfileStatsWriter() {
+	tlsProfileStatsOutcomeQueue = make(chan tlsProfileOutcomeReport, tlsProfileStatsOutcomeQueueSize)
+	go func() {
+		for report := range tlsProfileStatsOutcomeQueue {
+			applyTLSProfileOutcome(
+				report.serverAddr, report.tlsProfile, report.success,
+				report.handshakeDuration, report.p)
+		}
+	}()
+}
+
+// reportTLSProfileOutcome records the result of a single TLS handshake
+// attempt, keyed by serverAddr and tlsProfile, for asynchronous
+// persistence through the datastore. This is non-blocking: reports are
+// queued for a background writer and dropped, rather than stalling the
+// caller's dial, if that writer is falling behind.
+func reportTLSProfileOutcome(
+	serverAddr, tlsProfile string,
+	success bool,
+	handshakeDuration time.Duration,
+	p parameters.ParametersAccessor) {
+
+	tlsProfileStatsWriterOnce.Do(startTLSProfileStatsWriter)
+
+	select {
+	case tlsProfileStatsOutcomeQueue <- tlsProfileOutcomeReport{
+		serverAddr:        serverAddr,
+		tlsProfile:        tlsProfile,
+		success:           success,
+		handshakeDuration: handshakeDuration,
+		p:                 p,
+	}:
+	default:
+	}
+}
+
+// applyTLSProfileOutcome applies a single handshake outcome to the
+// persisted TLSProfileStats for serverAddr. Only called from the
+// background writer goroutine started by startTLSProfileStatsWriter.
+func applyTLSProfileOutcome(
+	serverAddr, tlsProfile string,
+	success bool,
+	handshakeDuration time.Duration,
+	p parameters.ParametersAccessor) {
+
+	tlsProfileStatsMutex.Lock()
+	defer tlsProfileStatsMutex.Unlock()
+
+	stats := loadTLSProfileStats(serverAddr)
+
+	outcome, ok := stats.Outcomes[tlsProfile]
+	if !ok {
+		outcome = new(tlsProfileOutcome)
+		stats.Outcomes[tlsProfile] = outcome
+	}
+
+	if success {
+		outcome.Successes++
+	} else {
+		outcome.Failures++
+	}
+	outcome.TotalHandshakeDuration += handshakeDuration
+
+	saveTLSProfileStats(serverAddr, stats)
+
+	touchTLSProfileStatsIndex(serverAddr, p)
+}
+
+// SelectTLSProfileForServer picks a TLS profile to use for a dial to
+// serverAddr, combining the base parameters.SelectRandomizedTLSProfileProbability
+// weighting with a UCB1-style bonus for profiles that have historically
+// succeeded against serverAddr. When serverAddr has fewer than
+// parameters.TLSProfileStatsMinObservations recorded outcomes, or with
+// probability parameters.TLSProfileStatsMinExploreProbability, selection
+// falls back to SelectTLSProfile so exploration never fully stops.
+func SelectTLSProfileForServer(
+	p parameters.ParametersAccessor, serverAddr string) string {
+
+	tlsProfileStatsMutex.Lock()
+	stats := loadTLSProfileStats(serverAddr)
+	tlsProfileStatsMutex.Unlock()
+
+	minObservations := int(p.Int(parameters.TLSProfileStatsMinObservations))
+
+	totalObservations := int64(0)
+	for _, outcome := range stats.Outcomes {
+		totalObservations += outcome.Successes + outcome.Failures
+	}
+
+	if int(totalObservations) < minObservations ||
+		p.WeightedCoinFlip(parameters.TLSProfileStatsMinExploreProbability) {
+
+		return SelectTLSProfile(p)
+	}
+
+	var bestProfile string
+	bestScore := math.Inf(-1)
+
+	for _, tlsProfile := range protocol.SupportedTLSProfiles {
+
+		outcome := stats.Outcomes[tlsProfile]
+
+		trials := int64(0)
+		successes := int64(0)
+		var totalHandshakeDuration time.Duration
+		if outcome != nil {
+			trials = outcome.Successes + outcome.Failures
+			successes = outcome.Successes
+			totalHandshakeDuration = outcome.TotalHandshakeDuration
+		}
+
+		// UCB1: mean success rate plus an exploration bonus that shrinks
+		// as a profile accumulates trials, less a small penalty scaled
+		// by mean handshake latency so that, among profiles with
+		// similar success rates, the historically faster one is
+		// preferred. Profiles with no trials are given an unbounded
+		// bonus so every profile is tried at least once before the
+		// bonus and latency terms can discriminate between them.
+		var score float64
+		if trials == 0 {
+			score = math.Inf(1)
+		} else {
+			meanSuccess := float64(successes) / float64(trials)
+			bonus := math.Sqrt(2 * math.Log(float64(totalObservations)) / float64(trials))
+			meanHandshakeDuration := totalHandshakeDuration.Seconds() / float64(trials)
+			latencyPenalty := tlsProfileStatsLatencyPenaltyWeight * meanHandshakeDuration
+			score = meanSuccess + bonus - latencyPenalty
+		}
+
+		if score > bestScore {
+			bestScore = score
+			bestProfile = tlsProfile
+		}
+	}
+
+	if bestProfile == "" {
+		return SelectTLSProfile(p)
+	}
+
+	return bestProfile
+}
+
+// loadTLSProfileStats returns the persisted TLSProfileStats for
+// serverAddr, or a freshly initialized, empty instance if none are
+// persisted yet.
+func loadTLSProfileStats(serverAddr string) *TLSProfileStats {
+
+	stats := &TLSProfileStats{Outcomes: make(map[string]*tlsProfileOutcome)}
+
+	value, err := datastore.GetKeyValue(tlsProfileStatsDatastoreKeyPrefix + serverAddr)
+	if err != nil || value == "" {
+		return stats
+	}
+
+	err = json.Unmarshal([]byte(value), stats)
+	if err != nil {
+		return &TLSProfileStats{Outcomes: make(map[string]*tlsProfileOutcome)}
+	}
+
+	if stats.Outcomes == nil {
+		stats.Outcomes = make(map[string]*tlsProfileOutcome)
+	}
+
+	return stats
+}
+
+// saveTLSProfileStats persists stats for serverAddr to the datastore.
+func saveTLSProfileStats(serverAddr string, stats *TLSProfileStats) {
+
+	value, err := json.Marshal(stats)
+	if err != nil {
+		return
+	}
+
+	_ = datastore.SetKeyValue(tlsProfileStatsDatastoreKeyPrefix+serverAddr, string(value))
+}
+
+// touchTLSProfileStatsIndex records serverAddr as most-recently-used in
+// the persisted LRU index, evicting the least-recently-used server's
+// stats once more than tlsProfileStatsMaxServers are tracked.
+func touchTLSProfileStatsIndex(serverAddr string, p parameters.ParametersAccessor) {
+
+	var index []string
+
+	value, err := datastore.GetKeyValue(tlsProfileStatsIndexDatastoreKey)
+	if err == nil && value != "" {
+		_ = json.Unmarshal([]byte(value), &index)
+	}
+
+	for i, address := range index {
+		if address == serverAddr {
+			index = append(index[:i], index[i+1:]...)
+			break
+		}
+	}
+	index = append(index, serverAddr)
+
+	for len(index) > tlsProfileStatsMaxServers {
+		evicted := index[0]
+		index = index[1:]
+		_ = datastore.SetKeyValue(tlsProfileStatsDatastoreKeyPrefix+evicted, "")
+	}
+
+	newValue, err := json.Marshal(index)
+	if err != nil {
+		return
+	}
+
+	_ = datastore.SetKeyValue(tlsProfileStatsIndexDatastoreKey, string(newValue))
+}
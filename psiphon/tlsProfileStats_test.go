@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/datastore"
+)
+
+// waitForTLSProfileStatsQueueDrain polls until the background writer
+// started by reportTLSProfileOutcome has applied all queued outcomes, or
+// fails the test if that doesn't happen within about a second.
+func waitForTLSProfileStatsQueueDrain(t *testing.T) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if len(tlsProfileStatsOutcomeQueue) == 0 {
+			// Give the writer goroutine time to finish applying the last
+			// dequeued report before returning.
+			time.Sleep(10 * time.Millisecond)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("TLS profile stats queue did not drain")
+}
+
+func TestSelectTLSProfileForServer(t *testing.T) {
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	serverAddr := "tls-profile-stats-test-server:443"
+
+	goodProfile := protocol.SupportedTLSProfiles[0]
+
+	// Seed a synthetic history where goodProfile always succeeds and
+	// every other profile always fails.
+
+	minObservations := int(clientParameters.Get().Int(
+		parameters.TLSProfileStatsMinObservations))
+
+	for i := 0; i < minObservations+50; i++ {
+		for _, tlsProfile := range protocol.SupportedTLSProfiles {
+			success := tlsProfile == goodProfile
+			reportTLSProfileOutcome(
+				serverAddr, tlsProfile, success, 10*time.Millisecond,
+				clientParameters.Get())
+		}
+	}
+
+	waitForTLSProfileStatsQueueDrain(t)
+
+	selected := make(map[string]int)
+
+	numSelections := 1000
+
+	for i := 0; i < numSelections; i++ {
+		profile := SelectTLSProfileForServer(clientParameters.Get(), serverAddr)
+		selected[profile]++
+	}
+
+	// The historically successful profile should be selected far more
+	// often than any single competitor, though the minimum explore rate
+	// means it should not monopolize every selection.
+
+	if selected[goodProfile] == 0 {
+		t.Errorf("expected goodProfile to be selected at all")
+	}
+
+	for _, tlsProfile := range protocol.SupportedTLSProfiles {
+		if tlsProfile == goodProfile {
+			continue
+		}
+		if selected[tlsProfile] > selected[goodProfile] {
+			t.Errorf(
+				"profile %s selected more often (%d) than historically "+
+					"successful profile %s (%d)",
+				tlsProfile, selected[tlsProfile], goodProfile, selected[goodProfile])
+		}
+	}
+
+	if selected[goodProfile] == numSelections {
+		t.Errorf("expected some exploration of other profiles")
+	}
+}
+
+func TestTLSProfileStatsEviction(t *testing.T) {
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	for i := 0; i < tlsProfileStatsMaxServers+10; i++ {
+		serverAddr := fmt.Sprintf("tls-profile-stats-eviction-test-server-%d:443", i)
+		reportTLSProfileOutcome(
+			serverAddr, protocol.SupportedTLSProfiles[0], true,
+			time.Millisecond, clientParameters.Get())
+	}
+
+	waitForTLSProfileStatsQueueDrain(t)
+
+	value, err := datastore.GetKeyValue(tlsProfileStatsIndexDatastoreKey)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	var index []string
+	err = json.Unmarshal([]byte(value), &index)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+
+	if len(index) > tlsProfileStatsMaxServers {
+		t.Errorf("expected eviction to cap index at %d entries, got %d",
+			tlsProfileStatsMaxServers, len(index))
+	}
+}